@@ -1,40 +1,80 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/urfave/cli"
 
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
 	pvController "sigs.k8s.io/sig-storage-lib-external-provisioner/controller"
 )
 
 var (
 	VERSION = "0.0.1"
 
-	FlagConfigFile            = "config"
-	FlagProvisionerName       = "provisioner-name"
-	EnvProvisionerName        = "PROVISIONER_NAME"
-	DefaultProvisionerName    = "rancher.io/local-path"
-	FlagNamespace             = "namespace"
-	EnvNamespace              = "POD_NAMESPACE"
-	DefaultNamespace          = "local-path-storage"
-	FlagHelperImage           = "helper-image"
-	EnvHelperImage            = "HELPER_IMAGE"
-	DefaultHelperImage        = "busybox"
-	FlagKubeconfig            = "kubeconfig"
-	DefaultKubeConfigFilePath = ".kube/config"
-	DefaultConfigFileKey      = "config.json"
-	DefaultConfigMapName      = "local-path-config"
+	FlagConfigFile         = "config"
+	FlagProvisionerName    = "provisioner-name"
+	EnvProvisionerName     = "PROVISIONER_NAME"
+	DefaultProvisionerName = "rancher.io/local-path"
+	FlagNamespace          = "namespace"
+	EnvNamespace           = "POD_NAMESPACE"
+	DefaultNamespace       = "local-path-storage"
+	FlagHelperImage        = "helper-image"
+	EnvHelperImage         = "HELPER_IMAGE"
+	DefaultHelperImage     = "busybox"
+	FlagKubeconfig         = "kubeconfig"
+	FlagContext            = "context"
+	FlagCluster            = "cluster"
+	DefaultConfigFileKey   = "config.json"
+	DefaultConfigMapName   = "local-path-config"
+
+	FlagLeaderElect              = "leader-elect"
+	EnvLeaderElect               = "LEADER_ELECT"
+	FlagLeaderElectLeaseName     = "leader-elect-lease-name"
+	EnvLeaderElectLeaseName      = "LEADER_ELECT_LEASE_NAME"
+	DefaultLeaderElectLeaseName  = "local-path-provisioner"
+	FlagLeaderElectLeaseDuration = "leader-elect-lease-duration"
+	EnvLeaderElectLeaseDuration  = "LEADER_ELECT_LEASE_DURATION"
+	FlagLeaderElectRenewDeadline = "leader-elect-renew-deadline"
+	EnvLeaderElectRenewDeadline  = "LEADER_ELECT_RENEW_DEADLINE"
+	FlagLeaderElectRetryPeriod   = "leader-elect-retry-period"
+	EnvLeaderElectRetryPeriod    = "LEADER_ELECT_RETRY_PERIOD"
+
+	FlagConfigReload = "config-reload"
+	EnvConfigReload  = "CONFIG_RELOAD"
+
+	FlagListenAddress    = "listen-address"
+	EnvListenAddress     = "LISTEN_ADDRESS"
+	DefaultListenAddress = ":8080"
+
+	FlagLogFormat    = "log-format"
+	EnvLogFormat     = "LOG_FORMAT"
+	DefaultLogFormat = "text"
+	FlagLogLevel     = "log-level"
+	EnvLogLevel      = "LOG_LEVEL"
+	DefaultLogLevel  = "info"
 )
 
 func cmdNotFound(c *cli.Context, command string) {
@@ -84,9 +124,59 @@ func StartCmd() cli.Command {
 			},
 			cli.StringFlag{
 				Name:  FlagKubeconfig,
-				Usage: "Paths to a kubeconfig. Only required when it is out-of-cluster.",
+				Usage: "Paths to a kubeconfig. Only required when it is out-of-cluster. Overrides KUBECONFIG and the default $HOME/.kube/config.",
+				Value: "",
+			},
+			cli.StringFlag{
+				Name:  FlagContext,
+				Usage: "The name of the kubeconfig context to use. Defaults to the kubeconfig's current context.",
+				Value: "",
+			},
+			cli.StringFlag{
+				Name:  FlagCluster,
+				Usage: "The name of the kubeconfig cluster to use. Defaults to the selected context's cluster.",
 				Value: "",
 			},
+			cli.BoolFlag{
+				Name:   FlagLeaderElect,
+				Usage:  "Enable leader election so only one of multiple Provisioner replicas is active at a time.",
+				EnvVar: EnvLeaderElect,
+			},
+			cli.StringFlag{
+				Name:   FlagLeaderElectLeaseName,
+				Usage:  "The name of the Lease object used for leader election.",
+				EnvVar: EnvLeaderElectLeaseName,
+				Value:  DefaultLeaderElectLeaseName,
+			},
+			cli.DurationFlag{
+				Name:   FlagLeaderElectLeaseDuration,
+				Usage:  "The duration non-leader candidates will wait before forcing acquisition of leadership.",
+				EnvVar: EnvLeaderElectLeaseDuration,
+				Value:  15 * time.Second,
+			},
+			cli.DurationFlag{
+				Name:   FlagLeaderElectRenewDeadline,
+				Usage:  "The duration the leader will retry refreshing leadership before giving it up.",
+				EnvVar: EnvLeaderElectRenewDeadline,
+				Value:  10 * time.Second,
+			},
+			cli.DurationFlag{
+				Name:   FlagLeaderElectRetryPeriod,
+				Usage:  "The duration candidates should wait between tries of actions.",
+				EnvVar: EnvLeaderElectRetryPeriod,
+				Value:  2 * time.Second,
+			},
+			cli.BoolTFlag{
+				Name:   FlagConfigReload,
+				Usage:  "Watch the local-path-config ConfigMap and hot-reload the Provisioner configuration on change. Set to false to keep the startup-only behavior, e.g. when --config points at a file outside the ConfigMap.",
+				EnvVar: EnvConfigReload,
+			},
+			cli.StringFlag{
+				Name:   FlagListenAddress,
+				Usage:  "The address to serve /healthz, /readyz and /metrics on.",
+				EnvVar: EnvListenAddress,
+				Value:  DefaultListenAddress,
+			},
 		},
 		Action: func(c *cli.Context) {
 			if err := startDaemon(c); err != nil {
@@ -96,26 +186,29 @@ func StartCmd() cli.Command {
 	}
 }
 
-func homeDir() string {
-	if h := os.Getenv("HOME"); h != "" {
-		return h
-	}
-	return os.Getenv("USERPROFILE") // windows
-}
-
-func loadConfig(kubeconfig string) (*rest.Config, error) {
+// loadConfig prefers in-cluster config, and otherwise falls back to the
+// standard kubeconfig loading rules: the KUBECONFIG env var (including
+// colon-separated merged paths), the explicit --kubeconfig flag as an
+// override, and finally the recommended $HOME/.kube/config.
+func loadConfig(kubeconfig, kubeContext, kubeCluster string) (*rest.Config, error) {
 	if c, err := rest.InClusterConfig(); err == nil {
 		return c, nil
 	}
-	home := homeDir()
-	if kubeconfig == "" && home != "" {
-		kubeconfig = filepath.Join(home, DefaultKubeConfigFilePath)
+
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if kubeconfig != "" {
+		loadingRules.ExplicitPath = kubeconfig
+	}
+
+	overrides := &clientcmd.ConfigOverrides{}
+	if kubeContext != "" {
+		overrides.CurrentContext = kubeContext
 	}
-	_, err := os.Stat(kubeconfig)
-	if err != nil {
-		return nil, err
+	if kubeCluster != "" {
+		overrides.Context.Cluster = kubeCluster
 	}
-	return clientcmd.BuildConfigFromFlags("", kubeconfig)
+
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides).ClientConfig()
 }
 
 func findConfigFileFromConfigMap(kubeClient clientset.Interface, namespace string) (string, error) {
@@ -130,11 +223,129 @@ func findConfigFileFromConfigMap(kubeClient clientset.Interface, namespace strin
 	return configFile, nil
 }
 
+// configReloader is implemented by the Provisioner type and lets
+// watchConfigMap push raw config updates, which ReloadConfig validates,
+// without depending on the concrete Provisioner type.
+type configReloader interface {
+	ReloadConfig(cfg string) error
+}
+
+func newEventRecorder(kubeClient clientset.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "local-path-provisioner"})
+}
+
+// watchConfigMap watches the local-path-config ConfigMap in namespace and
+// pushes every update into reloader.ReloadConfig. If ReloadConfig rejects the
+// new config, the last-known-good config keeps running and the failure is
+// logged and recorded as a Warning Event on the ConfigMap.
+func watchConfigMap(kubeClient clientset.Interface, namespace string, reloader configReloader, stopCh <-chan struct{}) {
+	recorder := newEventRecorder(kubeClient)
+	selector := fields.OneTermEqualSelector("metadata.name", DefaultConfigMapName)
+	lw := cache.NewListWatchFromClient(kubeClient.CoreV1().RESTClient(), "configmaps", namespace, selector)
+
+	reload := func(obj interface{}) {
+		cm, ok := obj.(*corev1.ConfigMap)
+		if !ok {
+			return
+		}
+		cfg, ok := cm.Data[DefaultConfigFileKey]
+		if !ok {
+			return
+		}
+		log := logrus.WithFields(logrus.Fields{"namespace": cm.Namespace, "configmap": cm.Name})
+		if err := reloader.ReloadConfig(cfg); err != nil {
+			log.Errorf("failed to reload config, keeping last-known-good config: %v", err)
+			recorder.Eventf(cm, corev1.EventTypeWarning, "ConfigReloadFailed", "failed to reload local-path-provisioner config: %v", err)
+			return
+		}
+		log.Info("reloaded config from ConfigMap")
+	}
+
+	_, informer := cache.NewInformer(lw, &corev1.ConfigMap{}, 0, cache.ResourceEventHandlerFuncs{
+		AddFunc:    reload,
+		UpdateFunc: func(old, new interface{}) { reload(new) },
+	})
+	go informer.Run(stopCh)
+}
+
+// startHealthServer serves /healthz, /readyz and /metrics on listenAddress
+// until stopCh is closed, at which point it is shut down gracefully. ready
+// is flipped to 1 once the provisioner controller is actually running.
+func startHealthServer(listenAddress string, ready *int32, stopCh <-chan struct{}) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(ready) == 1 {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	mux.Handle("/metrics", promhttp.Handler())
+
+	srv := &http.Server{Addr: listenAddress, Handler: mux}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logrus.Errorf("health/metrics server error: %v", err)
+		}
+	}()
+	go func() {
+		<-stopCh
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			logrus.Errorf("failed to shut down health/metrics server cleanly: %v", err)
+		}
+	}()
+}
+
+// buildLeaseLock builds the Lease resourcelock used for leader election.
+func buildLeaseLock(kubeClient clientset.Interface, namespace, leaseName, identity string) *resourcelock.LeaseLock {
+	return &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      leaseName,
+			Namespace: namespace,
+		},
+		Client: kubeClient.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+	}
+}
+
+// leaderElectionContext returns a context that is canceled as soon as stopCh
+// is closed, so leaderelection.RunOrDie releases the lease and returns
+// instead of continuing to renew it after the provisioner has stopped.
+func leaderElectionContext(stopCh <-chan struct{}) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+	return ctx
+}
+
+// runUntilStop invokes run with stop, marking ready while run is active and
+// clearing it again once run returns (i.e. once stop is closed). Used for
+// both the process-wide stopCh and a per-leadership-term stop channel, so
+// the controller actually stops on whichever one fires first.
+func runUntilStop(run func(<-chan struct{}), ready *int32, stop <-chan struct{}) {
+	atomic.StoreInt32(ready, 1)
+	logrus.Debug("Provisioner started")
+	run(stop)
+	logrus.Debug("Provisioner stopped")
+	atomic.StoreInt32(ready, 0)
+}
+
 func startDaemon(c *cli.Context) error {
 	stopCh := make(chan struct{})
 	RegisterShutdownChannel(stopCh)
 
-	config, err := loadConfig(c.String(FlagKubeconfig))
+	config, err := loadConfig(c.String(FlagKubeconfig), c.String(FlagContext), c.String(FlagCluster))
 	if err != nil {
 		return errors.Wrap(err, "unable to get client config")
 	}
@@ -169,42 +380,126 @@ func startDaemon(c *cli.Context) error {
 		return fmt.Errorf("invalid empty flag %v", FlagHelperImage)
 	}
 
+	var ready int32
+	startHealthServer(c.String(FlagListenAddress), &ready, stopCh)
+
+	if c.String(FlagConfigFile) != "" {
+		data, err := ioutil.ReadFile(configFile)
+		if err != nil {
+			return errors.Wrapf(err, "unable to read config file %v", configFile)
+		}
+		configFile = string(data)
+	}
+
 	provisioner, err := NewProvisioner(stopCh, kubeClient, configFile, namespace, helperImage)
 	if err != nil {
 		return err
 	}
+	if c.BoolT(FlagConfigReload) {
+		watchConfigMap(kubeClient, namespace, provisioner, stopCh)
+	}
 	pc := pvController.NewProvisionController(
 		kubeClient,
 		provisionerName,
 		provisioner,
 		serverVersion.GitVersion,
 	)
-	logrus.Debug("Provisioner started")
-	pc.Run(stopCh)
-	logrus.Debug("Provisioner stopped")
+
+	runProvisioner := func(stop <-chan struct{}) {
+		runUntilStop(pc.Run, &ready, stop)
+	}
+
+	if !c.Bool(FlagLeaderElect) {
+		runProvisioner(stopCh)
+		return nil
+	}
+
+	id, err := os.Hostname()
+	if err != nil {
+		return errors.Wrap(err, "unable to get hostname for leader election identity")
+	}
+
+	lock := buildLeaseLock(kubeClient, namespace, c.String(FlagLeaderElectLeaseName), id)
+
+	leaderelection.RunOrDie(leaderElectionContext(stopCh), leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		ReleaseOnCancel: true,
+		LeaseDuration:   c.Duration(FlagLeaderElectLeaseDuration),
+		RenewDeadline:   c.Duration(FlagLeaderElectRenewDeadline),
+		RetryPeriod:     c.Duration(FlagLeaderElectRetryPeriod),
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				logrus.Infof("%v became leader, starting provisioner", id)
+				// Stop the controller the moment this term's ctx is
+				// canceled (lost leadership or shutdown), not only on the
+				// process-wide stopCh.
+				runProvisioner(ctx.Done())
+			},
+			OnStoppedLeading: func() {
+				// OnStartedLeading's ctx is canceled before this fires,
+				// which tells the controller to stop; this callback does
+				// not wait for it. Once leaderelection.RunOrDie returns
+				// below, startDaemon and main return normally so
+				// Kubernetes can restart the pod to re-contend. The HTTP
+				// server is shut down gracefully only when stopCh is
+				// closed, not when leadership alone is lost.
+				logrus.Infof("%v stopped leading", id)
+			},
+			OnNewLeader: func(identity string) {
+				if identity == id {
+					return
+				}
+				logrus.Infof("current leader: %v", identity)
+			},
+		},
+	})
 	return nil
 }
 
 func main() {
-	logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
-
 	a := cli.NewApp()
 	a.Version = VERSION
 	a.Usage = "Local Path Provisioner"
 
 	a.Before = func(c *cli.Context) error {
+		switch format := c.GlobalString(FlagLogFormat); format {
+		case "json":
+			logrus.SetFormatter(&logrus.JSONFormatter{})
+		case "text":
+			logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+		default:
+			return fmt.Errorf("invalid %v %v, must be one of: text, json", FlagLogFormat, format)
+		}
+
+		level, err := logrus.ParseLevel(c.GlobalString(FlagLogLevel))
+		if err != nil {
+			return errors.Wrapf(err, "invalid %v", FlagLogLevel)
+		}
 		if c.GlobalBool("debug") {
-			logrus.SetLevel(logrus.DebugLevel)
+			level = logrus.DebugLevel
 		}
+		logrus.SetLevel(level)
 		return nil
 	}
 
 	a.Flags = []cli.Flag{
 		cli.BoolFlag{
 			Name:   "debug, d",
-			Usage:  "enable debug logging level",
+			Usage:  "enable debug logging level (shorthand for --log-level=debug)",
 			EnvVar: "RANCHER_DEBUG",
 		},
+		cli.StringFlag{
+			Name:   FlagLogFormat,
+			Usage:  "Log format: text or json.",
+			EnvVar: EnvLogFormat,
+			Value:  DefaultLogFormat,
+		},
+		cli.StringFlag{
+			Name:   FlagLogLevel,
+			Usage:  "Log level: trace, debug, info, warn, error.",
+			EnvVar: EnvLogLevel,
+			Value:  DefaultLogLevel,
+		},
 	}
 	a.Commands = []cli.Command{
 		StartCmd(),
@@ -215,4 +510,4 @@ func main() {
 	if err := a.Run(os.Args); err != nil {
 		logrus.Fatalf("Critical error: %v", err)
 	}
-}
\ No newline at end of file
+}
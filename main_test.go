@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLeaderElectionContextCanceledOnStopCh(t *testing.T) {
+	stopCh := make(chan struct{})
+	ctx := leaderElectionContext(stopCh)
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("context was canceled before stopCh was closed")
+	default:
+	}
+
+	close(stopCh)
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("context was not canceled after stopCh was closed")
+	}
+}
+
+func TestRunUntilStopStopsWhenChannelCloses(t *testing.T) {
+	var ready int32
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	blockingRun := func(s <-chan struct{}) {
+		<-s
+		close(done)
+	}
+
+	go runUntilStop(blockingRun, &ready, stop)
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&ready) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected ready to become 1 while run is active")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(stop)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("run did not observe the closed stop channel")
+	}
+
+	deadline = time.Now().Add(time.Second)
+	for atomic.LoadInt32(&ready) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected ready to be reset to 0 after run stopped")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBuildLeaseLock(t *testing.T) {
+	kubeClient := fake.NewSimpleClientset()
+
+	lock := buildLeaseLock(kubeClient, "local-path-storage", "local-path-provisioner", "test-identity")
+
+	if lock.LeaseMeta.Name != "local-path-provisioner" {
+		t.Errorf("expected lease name %v, got %v", "local-path-provisioner", lock.LeaseMeta.Name)
+	}
+	if lock.LeaseMeta.Namespace != "local-path-storage" {
+		t.Errorf("expected lease namespace %v, got %v", "local-path-storage", lock.LeaseMeta.Namespace)
+	}
+	if lock.LockConfig.Identity != "test-identity" {
+		t.Errorf("expected identity %v, got %v", "test-identity", lock.LockConfig.Identity)
+	}
+}
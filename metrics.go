@@ -0,0 +1,70 @@
+package main
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Metrics exposed on /metrics. They are updated from the provisioner's
+// Provision/Delete call sites so operators can alert on failing provisions
+// without having to scrape pod logs.
+var (
+	provisionAttemptsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "local_path_provisioner",
+		Name:      "provision_attempts_total",
+		Help:      "Total number of volume provision attempts, by node.",
+	}, []string{"node"})
+
+	provisionSuccessesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "local_path_provisioner",
+		Name:      "provision_successes_total",
+		Help:      "Total number of successful volume provisions, by node.",
+	}, []string{"node"})
+
+	provisionFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "local_path_provisioner",
+		Name:      "provision_failures_total",
+		Help:      "Total number of failed volume provisions, by node and failure reason.",
+	}, []string{"node", "reason"})
+
+	deleteAttemptsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "local_path_provisioner",
+		Name:      "delete_attempts_total",
+		Help:      "Total number of volume delete attempts, by node.",
+	}, []string{"node"})
+
+	deleteSuccessesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "local_path_provisioner",
+		Name:      "delete_successes_total",
+		Help:      "Total number of successful volume deletes, by node.",
+	}, []string{"node"})
+
+	deleteFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "local_path_provisioner",
+		Name:      "delete_failures_total",
+		Help:      "Total number of failed volume deletes, by node and failure reason.",
+	}, []string{"node", "reason"})
+
+	helperPodDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "local_path_provisioner",
+		Name:      "helper_pod_duration_seconds",
+		Help:      "Time taken for the create/delete helper pod to complete, by node and operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"node", "operation"})
+
+	nodeVolumeCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "local_path_provisioner",
+		Name:      "node_volume_count",
+		Help:      "Number of local-path volumes provisioned minus deleted per node since this process started.",
+	}, []string{"node"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		provisionAttemptsTotal,
+		provisionSuccessesTotal,
+		provisionFailuresTotal,
+		deleteAttemptsTotal,
+		deleteSuccessesTotal,
+		deleteFailuresTotal,
+		helperPodDurationSeconds,
+		nodeVolumeCount,
+	)
+}
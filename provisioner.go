@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clientset "k8s.io/client-go/kubernetes"
+	pvController "sigs.k8s.io/sig-storage-lib-external-provisioner/controller"
+)
+
+// NodeDefaultNonListedNodes is the nodePathMap key used as a fallback for
+// nodes that have no entry of their own.
+const NodeDefaultNonListedNodes = "DEFAULT_PATH_FOR_NON_LISTED_NODES"
+
+// NodePathMapData is the on-disk/ConfigMap representation of the paths
+// local-path-provisioner is allowed to use on a given node.
+type NodePathMapData struct {
+	Node  string   `json:"node"`
+	Paths []string `json:"paths"`
+}
+
+// ConfigData is the raw, on-disk/ConfigMap JSON config format.
+type ConfigData struct {
+	NodePathMap []*NodePathMapData `json:"nodePathMap"`
+}
+
+// NodePathMap is the validated, de-duplicated set of paths for a single node.
+type NodePathMap struct {
+	Paths map[string]struct{}
+}
+
+// Config is the validated, parsed form of ConfigData.
+type Config struct {
+	NodePathMap map[string]*NodePathMap
+}
+
+// Provisioner implements pvController.Provisioner, creating and deleting
+// host-path backed PersistentVolumes on a node-local directory. Its config
+// can be swapped at runtime via ReloadConfig.
+type Provisioner struct {
+	stopCh      <-chan struct{}
+	kubeClient  clientset.Interface
+	namespace   string
+	helperImage string
+
+	configMutex sync.RWMutex
+	configData  *ConfigData
+	config      *Config
+}
+
+// NewProvisioner loads and validates configFile before returning, so a
+// Provisioner is never constructed with an invalid config.
+func NewProvisioner(stopCh <-chan struct{}, kubeClient clientset.Interface, configFile, namespace, helperImage string) (*Provisioner, error) {
+	p := &Provisioner{
+		stopCh:      stopCh,
+		kubeClient:  kubeClient,
+		namespace:   namespace,
+		helperImage: helperImage,
+	}
+	if err := p.ReloadConfig(configFile); err != nil {
+		return nil, errors.Wrap(err, "failed to load provisioner config")
+	}
+	return p, nil
+}
+
+// ReloadConfig parses and validates cfg, then atomically swaps it in. If cfg
+// is invalid, the last-known-good config keeps running and an error is
+// returned so callers can log/surface the failure.
+func (p *Provisioner) ReloadConfig(cfg string) error {
+	configData, config, err := parseAndValidateConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	p.configMutex.Lock()
+	defer p.configMutex.Unlock()
+	p.configData = configData
+	p.config = config
+	return nil
+}
+
+func parseAndValidateConfig(cfg string) (*ConfigData, *Config, error) {
+	configData := &ConfigData{}
+	if err := json.Unmarshal([]byte(cfg), configData); err != nil {
+		return nil, nil, errors.Wrap(err, "invalid json")
+	}
+	if len(configData.NodePathMap) == 0 {
+		return nil, nil, fmt.Errorf("nodePathMap must not be empty")
+	}
+
+	config := &Config{NodePathMap: map[string]*NodePathMap{}}
+	for _, n := range configData.NodePathMap {
+		if n.Node == "" {
+			return nil, nil, fmt.Errorf("node must not be empty in nodePathMap entry")
+		}
+		if _, exists := config.NodePathMap[n.Node]; exists {
+			return nil, nil, fmt.Errorf("duplicate node %v in nodePathMap", n.Node)
+		}
+		if len(n.Paths) == 0 {
+			return nil, nil, fmt.Errorf("paths must not be empty for node %v", n.Node)
+		}
+		paths := map[string]struct{}{}
+		for _, path := range n.Paths {
+			if !filepath.IsAbs(path) {
+				return nil, nil, fmt.Errorf("path %v for node %v must be absolute", path, n.Node)
+			}
+			paths[path] = struct{}{}
+		}
+		config.NodePathMap[n.Node] = &NodePathMap{Paths: paths}
+	}
+	return configData, config, nil
+}
+
+// basePathForNode returns one of the configured paths for node, falling back
+// to NodeDefaultNonListedNodes when node has no entry of its own. When several
+// paths are configured, which one is returned is not defined.
+func (p *Provisioner) basePathForNode(node string) (string, error) {
+	p.configMutex.RLock()
+	defer p.configMutex.RUnlock()
+
+	if p.config == nil {
+		return "", fmt.Errorf("provisioner has no config loaded")
+	}
+	npMap, ok := p.config.NodePathMap[node]
+	if !ok {
+		npMap, ok = p.config.NodePathMap[NodeDefaultNonListedNodes]
+		if !ok {
+			return "", fmt.Errorf("no configured path for node %v", node)
+		}
+	}
+	for path := range npMap.Paths {
+		return path, nil
+	}
+	return "", fmt.Errorf("no configured path for node %v", node)
+}
+
+func (p *Provisioner) Provision(ctx context.Context, opts pvController.ProvisionOptions) (*v1.PersistentVolume, pvController.ProvisioningState, error) {
+	node := ""
+	if opts.SelectedNode != nil {
+		node = opts.SelectedNode.Name
+	}
+	log := logrus.WithFields(logrus.Fields{
+		"pvc":  fmt.Sprintf("%v/%v", opts.PVC.Namespace, opts.PVC.Name),
+		"pv":   opts.PVName,
+		"node": node,
+	})
+	provisionAttemptsTotal.WithLabelValues(node).Inc()
+
+	basePath, err := p.basePathForNode(node)
+	if err != nil {
+		provisionFailuresTotal.WithLabelValues(node, "no-path-for-node").Inc()
+		log.Errorf("failed to provision volume: %v", err)
+		return nil, pvController.ProvisioningFinished, err
+	}
+	path := filepath.Join(basePath, opts.PVName)
+	helperPodName := fmt.Sprintf("helper-pod-create-%v", opts.PVName)
+	log = log.WithFields(logrus.Fields{"path": path, "helper_pod": helperPodName})
+
+	start := time.Now()
+	err = p.runHelperPod(ctx, helperPodName, node, path, []string{"mkdir", "-m", "0777", "-p", path})
+	helperPodDurationSeconds.WithLabelValues(node, "create").Observe(time.Since(start).Seconds())
+	if err != nil {
+		provisionFailuresTotal.WithLabelValues(node, "helper-pod-failed").Inc()
+		log.Errorf("failed to create volume directory: %v", err)
+		return nil, pvController.ProvisioningFinished, errors.Wrap(err, "failed to create volume directory")
+	}
+
+	reclaimPolicy := v1.PersistentVolumeReclaimDelete
+	if opts.StorageClass.ReclaimPolicy != nil {
+		reclaimPolicy = *opts.StorageClass.ReclaimPolicy
+	}
+
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: opts.PVName,
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeReclaimPolicy: reclaimPolicy,
+			AccessModes:                   opts.PVC.Spec.AccessModes,
+			Capacity: v1.ResourceList{
+				v1.ResourceStorage: opts.PVC.Spec.Resources.Requests[v1.ResourceStorage],
+			},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				HostPath: &v1.HostPathVolumeSource{
+					Path: path,
+				},
+			},
+			NodeAffinity: &v1.VolumeNodeAffinity{
+				Required: &v1.NodeSelector{
+					NodeSelectorTerms: []v1.NodeSelectorTerm{
+						{
+							MatchExpressions: []v1.NodeSelectorRequirement{
+								{
+									Key:      "kubernetes.io/hostname",
+									Operator: v1.NodeSelectorOpIn,
+									Values:   []string{node},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	provisionSuccessesTotal.WithLabelValues(node).Inc()
+	nodeVolumeCount.WithLabelValues(node).Inc()
+	log.Info("provisioned volume")
+	return pv, pvController.ProvisioningFinished, nil
+}
+
+func (p *Provisioner) Delete(ctx context.Context, pv *v1.PersistentVolume) error {
+	node, path, err := nodeAndPathFromPV(pv)
+	if err != nil {
+		return err
+	}
+	helperPodName := fmt.Sprintf("helper-pod-delete-%v", pv.Name)
+	log := logrus.WithFields(logrus.Fields{
+		"pv":         pv.Name,
+		"node":       node,
+		"path":       path,
+		"helper_pod": helperPodName,
+	})
+	deleteAttemptsTotal.WithLabelValues(node).Inc()
+
+	start := time.Now()
+	err = p.runHelperPod(ctx, helperPodName, node, path, []string{"rm", "-rf", path})
+	helperPodDurationSeconds.WithLabelValues(node, "delete").Observe(time.Since(start).Seconds())
+	if err != nil {
+		deleteFailuresTotal.WithLabelValues(node, "helper-pod-failed").Inc()
+		log.Errorf("failed to delete volume directory: %v", err)
+		return errors.Wrap(err, "failed to delete volume directory")
+	}
+
+	deleteSuccessesTotal.WithLabelValues(node).Inc()
+	nodeVolumeCount.WithLabelValues(node).Dec()
+	log.Info("deleted volume")
+	return nil
+}
+
+func nodeAndPathFromPV(pv *v1.PersistentVolume) (string, string, error) {
+	if pv.Spec.HostPath == nil {
+		return "", "", fmt.Errorf("volume %v has no hostPath source", pv.Name)
+	}
+	path := pv.Spec.HostPath.Path
+
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return "", "", fmt.Errorf("volume %v has no node affinity", pv.Name)
+	}
+	for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		for _, expr := range term.MatchExpressions {
+			if expr.Key == "kubernetes.io/hostname" && len(expr.Values) > 0 {
+				return expr.Values[0], path, nil
+			}
+		}
+	}
+	return "", "", fmt.Errorf("volume %v has no kubernetes.io/hostname node affinity", pv.Name)
+}
+
+// runHelperPod runs a short-lived pod on node that mounts hostDir's parent
+// directory at the same path and runs command, blocking until it completes or ctx is done. The pod is always
+// cleaned up afterwards.
+func (p *Provisioner) runHelperPod(ctx context.Context, name, node, hostDir string, command []string) error {
+	hostPathType := v1.HostPathDirectoryOrCreate
+	parentDir := filepath.Dir(hostDir)
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: p.namespace,
+		},
+		Spec: v1.PodSpec{
+			NodeName:      node,
+			RestartPolicy: v1.RestartPolicyNever,
+			Containers: []v1.Container{
+				{
+					Name:    "helper-pod",
+					Image:   p.helperImage,
+					Command: command,
+					VolumeMounts: []v1.VolumeMount{
+						{Name: "host-dir", MountPath: parentDir},
+					},
+				},
+			},
+			Volumes: []v1.Volume{
+				{
+					Name: "host-dir",
+					VolumeSource: v1.VolumeSource{
+						HostPath: &v1.HostPathVolumeSource{
+							Path: parentDir,
+							Type: &hostPathType,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	if _, err := p.kubeClient.CoreV1().Pods(p.namespace).Create(pod); err != nil {
+		return errors.Wrap(err, "failed to create helper pod")
+	}
+	defer func() {
+		if err := p.kubeClient.CoreV1().Pods(p.namespace).Delete(name, &metav1.DeleteOptions{}); err != nil {
+			logrus.Errorf("failed to clean up helper pod %v/%v: %v", p.namespace, name, err)
+		}
+	}()
+
+	return wait.PollImmediateUntil(time.Second, func() (bool, error) {
+		got, err := p.kubeClient.CoreV1().Pods(p.namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		switch got.Status.Phase {
+		case v1.PodSucceeded:
+			return true, nil
+		case v1.PodFailed:
+			return false, fmt.Errorf("helper pod %v/%v failed", p.namespace, name)
+		default:
+			return false, nil
+		}
+	}, ctx.Done())
+}
@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestParseAndValidateConfigValid(t *testing.T) {
+	cfg := `{"nodePathMap":[{"node":"DEFAULT_PATH_FOR_NON_LISTED_NODES","paths":["/opt/local-path-provisioner"]}]}`
+
+	_, config, err := parseAndValidateConfig(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	npMap, ok := config.NodePathMap[NodeDefaultNonListedNodes]
+	if !ok {
+		t.Fatalf("expected %v entry in NodePathMap", NodeDefaultNonListedNodes)
+	}
+	if _, ok := npMap.Paths["/opt/local-path-provisioner"]; !ok {
+		t.Fatalf("expected path /opt/local-path-provisioner to be present")
+	}
+}
+
+func TestParseAndValidateConfigInvalidJSON(t *testing.T) {
+	if _, _, err := parseAndValidateConfig("not json"); err == nil {
+		t.Fatal("expected an error for invalid json")
+	}
+}
+
+func TestParseAndValidateConfigEmptyNodePathMap(t *testing.T) {
+	if _, _, err := parseAndValidateConfig(`{"nodePathMap":[]}`); err == nil {
+		t.Fatal("expected an error for an empty nodePathMap")
+	}
+}
+
+func TestParseAndValidateConfigDuplicateNode(t *testing.T) {
+	cfg := `{"nodePathMap":[{"node":"node1","paths":["/a"]},{"node":"node1","paths":["/b"]}]}`
+	if _, _, err := parseAndValidateConfig(cfg); err == nil {
+		t.Fatal("expected an error for a duplicate node entry")
+	}
+}
+
+func TestParseAndValidateConfigRelativePath(t *testing.T) {
+	cfg := `{"nodePathMap":[{"node":"node1","paths":["relative/path"]}]}`
+	if _, _, err := parseAndValidateConfig(cfg); err == nil {
+		t.Fatal("expected an error for a non-absolute path")
+	}
+}
+
+func TestProvisionerReloadConfigKeepsLastGoodOnFailure(t *testing.T) {
+	p := &Provisioner{}
+	if err := p.ReloadConfig(`{"nodePathMap":[{"node":"node1","paths":["/a"]}]}`); err != nil {
+		t.Fatalf("unexpected error loading valid config: %v", err)
+	}
+
+	if err := p.ReloadConfig("not json"); err == nil {
+		t.Fatal("expected an error for invalid config")
+	}
+
+	if _, ok := p.config.NodePathMap["node1"]; !ok {
+		t.Fatal("expected last-known-good config to still be in effect after a failed reload")
+	}
+}